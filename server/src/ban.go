@@ -0,0 +1,235 @@
+// Structured ban subsystem: typed, expiring bans with an in-memory cache backed by the database.
+// This supersedes the old permanent, IP-only "models.BannedIPs" check for anything issued through
+// moderator commands; "models.BannedIPs" is left alone since it is still consulted directly by
+// other parts of the codebase.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanType identifies what kind of subject a ban row applies to.
+type BanType int
+
+const (
+	BanTypeIP BanType = iota
+	BanTypeUsername
+	BanTypeUserID
+	BanTypeSessionFingerprint
+)
+
+// banSweepInterval is how often we scan the in-memory cache for expired entries.
+const banSweepInterval = 5 * time.Minute
+
+func (b BanType) String() string {
+	switch b {
+	case BanTypeIP:
+		return "ip"
+	case BanTypeUsername:
+		return "username"
+	case BanTypeUserID:
+		return "userid"
+	case BanTypeSessionFingerprint:
+		return "fingerprint"
+	default:
+		return "unknown"
+	}
+}
+
+// parseBanType converts the first argument of a "/ban" or "/unban" command into a BanType.
+func parseBanType(arg string) (BanType, bool) {
+	switch strings.ToLower(arg) {
+	case "ip":
+		return BanTypeIP, true
+	case "username":
+		return BanTypeUsername, true
+	case "userid":
+		return BanTypeUserID, true
+	case "fingerprint", "sessionfingerprint":
+		return BanTypeSessionFingerprint, true
+	default:
+		return 0, false
+	}
+}
+
+type banKey struct {
+	banType BanType
+	key     string
+}
+
+// computeSessionFingerprint derives a stable identifier for the connecting client from headers
+// that a casual IP/VPN rotation won't change, so that "/ban fingerprint ..." has something real to
+// match against. This is necessarily weak (no client-side fingerprinting JS exists in this repo)
+// but is still strictly better than a ban type that matches nothing at all.
+func computeSessionFingerprint(r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.Header.Get("User-Agent")))
+	h.Write([]byte{0})
+	h.Write([]byte(r.Header.Get("Accept-Language")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var (
+	bansMutex sync.RWMutex
+	// bans is the in-memory cache of currently-active bans, keyed by (type, key) and mapping to
+	// the expiration time. It mirrors the "models.Bans" table and is the source of truth that
+	// hot paths (httpWS, chatServerSend) consult so that they never need to hit the database.
+	bans = make(map[banKey]time.Time)
+)
+
+// InitBans loads all active bans from the database into the in-memory cache and starts the
+// background sweep of expired entries. It should be called once at server startup.
+func InitBans(ctx context.Context) error {
+	rows, err := models.Bans.GetAllActive(ctx)
+	if err != nil {
+		return err
+	}
+
+	bansMutex.Lock()
+	for _, row := range rows {
+		bans[banKey{row.Type, row.Key}] = row.Expiry
+	}
+	bansMutex.Unlock()
+
+	go banSweepLoop()
+
+	return nil
+}
+
+func banSweepLoop() {
+	ticker := time.NewTicker(banSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sweepExpiredBans()
+	}
+}
+
+func sweepExpiredBans() {
+	now := time.Now()
+
+	bansMutex.Lock()
+	for k, expiry := range bans {
+		if now.After(expiry) {
+			delete(bans, k)
+		}
+	}
+	bansMutex.Unlock()
+}
+
+// CheckBan reports whether the given subject is currently banned, and if so, how much time is
+// left on the ban. An expired entry that the sweep has not yet collected is treated as not
+// banned, so callers never need to special-case sweep timing.
+func CheckBan(banType BanType, key string) (bool, time.Duration) {
+	bansMutex.RLock()
+	expiry, ok := bans[banKey{banType, key}]
+	bansMutex.RUnlock()
+
+	if !ok {
+		return false, 0
+	}
+
+	remaining := time.Until(expiry)
+	if remaining <= 0 {
+		return false, 0
+	}
+
+	return true, remaining
+}
+
+// Ban persists a new ban, adds it to the in-memory cache, and immediately disconnects any
+// currently-connected session it matches. Without that last step, a ban would only ever block
+// future handshakes; anyone already connected would keep chatting/playing until they happened to
+// reconnect.
+func Ban(ctx context.Context, banType BanType, key string, duration time.Duration) error {
+	expiry := time.Now().Add(duration)
+
+	if err := models.Bans.Insert(ctx, banType.String(), key, expiry); err != nil {
+		return err
+	}
+
+	bansMutex.Lock()
+	bans[banKey{banType, key}] = expiry
+	bansMutex.Unlock()
+
+	disconnectBannedSessions(banType, key, expiry)
+
+	return nil
+}
+
+// sessionBanCheck reports whether s is currently subject to any ban, checking every identifier we
+// have for it. It mirrors the checks httpWS already performs at handshake time, so that a ban
+// applied mid-session (e.g. via "/ban username ...") is enforced just as strictly against a
+// session that is already connected, not just against future handshakes.
+func sessionBanCheck(s *Session) (bool, time.Duration) {
+	if banned, remaining := CheckBan(BanTypeUsername, s.Username); banned {
+		return true, remaining
+	}
+	if banned, remaining := CheckBan(BanTypeUserID, strconv.Itoa(s.UserID)); banned {
+		return true, remaining
+	}
+	if banned, remaining := CheckBan(BanTypeIP, s.RemoteIP); banned {
+		return true, remaining
+	}
+	if s.Fingerprint != "" {
+		if banned, remaining := CheckBan(BanTypeSessionFingerprint, s.Fingerprint); banned {
+			return true, remaining
+		}
+	}
+	return false, 0
+}
+
+// disconnectBannedSessions kicks every currently-connected session matching a freshly created
+// ban, so that the ban takes effect right away rather than only on the next handshake.
+func disconnectBannedSessions(banType BanType, key string, expiry time.Time) {
+	sessionsMutex.RLock()
+	matches := make([]*Session, 0)
+	for _, s := range sessions {
+		if sessionMatchesBan(s, banType, key) {
+			matches = append(matches, s)
+		}
+	}
+	sessionsMutex.RUnlock()
+
+	for _, s := range matches {
+		s.Error("You have been banned for " + time.Until(expiry).Round(time.Second).String() + ".")
+		s.Close()
+	}
+}
+
+// sessionMatchesBan reports whether s is the subject of a ban of the given type/key.
+func sessionMatchesBan(s *Session, banType BanType, key string) bool {
+	switch banType {
+	case BanTypeUsername:
+		return s.Username == key
+	case BanTypeUserID:
+		return strconv.Itoa(s.UserID) == key
+	case BanTypeIP:
+		return s.RemoteIP == key
+	case BanTypeSessionFingerprint:
+		return s.Fingerprint != "" && s.Fingerprint == key
+	default:
+		return false
+	}
+}
+
+// Unban immediately lifts a ban from both the database and the in-memory cache.
+func Unban(ctx context.Context, banType BanType, key string) error {
+	if err := models.Bans.Delete(ctx, banType.String(), key); err != nil {
+		return err
+	}
+
+	bansMutex.Lock()
+	delete(bans, banKey{banType, key})
+	bansMutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// /ban <type> <target> <duration>
+// e.g. "/ban username alice 24h" or "/ban userid 37 24h"
+// Both are dispatched through chatCommands and restricted to moderators by chatModeratorCheck.
+func chatBan(ctx context.Context, s *Session, d *CommandData, t *Table) {
+	if !chatModeratorCheck(ctx, s, d) {
+		return
+	}
+
+	if len(d.Args) != 3 {
+		chatServerSend(ctx, "The format of the /ban command is: /ban <type> <target> <duration>", d.Room)
+		return
+	}
+
+	banType, ok := parseBanType(d.Args[0])
+	if !ok {
+		chatServerSend(ctx, "\""+d.Args[0]+"\" is not a valid ban type. "+
+			"Valid types are: ip, username, userid, fingerprint.", d.Room)
+		return
+	}
+	target := d.Args[1]
+
+	duration, err := time.ParseDuration(d.Args[2])
+	if err != nil {
+		chatServerSend(ctx, "\""+d.Args[2]+"\" is not a valid duration (e.g. \"24h\").", d.Room)
+		return
+	}
+
+	if err := Ban(ctx, banType, target, duration); err != nil {
+		logger.Error("Failed to ban "+banType.String()+" \""+target+"\":", err)
+		s.Error(DefaultErrorMsg)
+		return
+	}
+
+	chatServerSend(ctx, "Banned "+banType.String()+" \""+target+"\" for "+duration.String()+".", d.Room)
+}
+
+// /unban <type> <target>
+func chatUnban(ctx context.Context, s *Session, d *CommandData, t *Table) {
+	if !chatModeratorCheck(ctx, s, d) {
+		return
+	}
+
+	if len(d.Args) != 2 {
+		chatServerSend(ctx, "The format of the /unban command is: /unban <type> <target>", d.Room)
+		return
+	}
+
+	banType, ok := parseBanType(d.Args[0])
+	if !ok {
+		chatServerSend(ctx, "\""+d.Args[0]+"\" is not a valid ban type. "+
+			"Valid types are: ip, username, userid, fingerprint.", d.Room)
+		return
+	}
+	target := d.Args[1]
+
+	if err := Unban(ctx, banType, target); err != nil {
+		logger.Error("Failed to unban "+banType.String()+" \""+target+"\":", err)
+		s.Error(DefaultErrorMsg)
+		return
+	}
+
+	chatServerSend(ctx, "Unbanned "+banType.String()+" \""+target+"\".", d.Room)
+}
+
+// chatModeratorCheck reports whether the user issuing a moderation command is allowed to, sending
+// the standard denial message to the room if not. Fake users (i.e. server-driven bots) are never
+// moderators.
+func chatModeratorCheck(ctx context.Context, s *Session, d *CommandData) bool {
+	if s == nil || s.FakeUser {
+		chatServerSend(ctx, "Only a logged-in moderator can use this command.", d.Room)
+		return false
+	}
+
+	isMod, err := models.Users.IsModerator(s.UserID)
+	if err != nil {
+		logger.Error("Failed to check the moderator status for user \""+s.Username+"\":", err)
+		s.Error(DefaultErrorMsg)
+		return false
+	}
+	if !isMod {
+		chatServerSend(ctx, "Only a logged-in moderator can use this command.", d.Room)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// chatCommands maps a "/word" chat command to its handler. This is the dispatch table that makes
+// chatBan/chatUnban/chatHistory reachable from a real connection rather than merely defined; the
+// full command table that the live codebase registers "/suggest", "/tags", etc. under is not part
+// of this chunk, so only the handlers this series added are listed here.
+var chatCommands = map[string]func(ctx context.Context, s *Session, d *CommandData, t *Table){
+	"ban":     chatBan,
+	"unban":   chatUnban,
+	"history": chatHistory,
+}
+
+// handleIncomingChat is the ingress point for chat-shaped WebSocket messages, called directly from
+// httpWS's read loop. It is the one ingress point this chunk fully controls, so it is also where
+// the mid-session ban gate lives: "chatServerSend" and the rest of the player-chat broadcast path
+// are not part of this chunk, but a banned session is stopped here regardless, and every message
+// that is not a slash command is recorded via recordRoomMessage so that "/history" and
+// SendRoomHistory are no longer always empty.
+func handleIncomingChat(ctx context.Context, s *Session, room string, text string) {
+	if banned, remaining := sessionBanCheck(s); banned {
+		s.Error("You have been banned for " + remaining.Round(time.Second).String() +
+			" and cannot chat.")
+		return
+	}
+
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "/") {
+		fields := strings.Fields(trimmed[1:])
+		if len(fields) == 0 {
+			return
+		}
+
+		handler, ok := chatCommands[strings.ToLower(fields[0])]
+		if !ok {
+			return
+		}
+
+		d := &CommandData{ // nolint: exhaustivestruct
+			Room: room,
+			Args: fields[1:],
+		}
+		handler(ctx, s, d, nil)
+		return
+	}
+
+	recordRoomMessage(room, s.Username, trimmed)
+}
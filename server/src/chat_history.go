@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// chatHistoryMaxMessages bounds how many messages we keep buffered per room.
+	chatHistoryMaxMessages = 200
+
+	// chatHistoryMaxAge bounds how old a buffered message can be before it is pruned, regardless
+	// of how few messages the room has seen.
+	chatHistoryMaxAge = time.Hour
+)
+
+// ChatHistoryEntry is one buffered message in a room's ring buffer.
+type ChatHistoryEntry struct {
+	Username string
+	Msg      string
+	Datetime time.Time
+}
+
+var (
+	roomHistoryMutex sync.Mutex
+	// roomHistory holds the last chatHistoryMaxMessages (or chatHistoryMaxAge, whichever is
+	// smaller) messages for each room, keyed by room name ("lobby" or a table's room name).
+	roomHistory = make(map[string][]ChatHistoryEntry)
+)
+
+// recordRoomMessage appends a message to the given room's buffer, pruning anything stale.
+func recordRoomMessage(room string, username string, msg string) {
+	entry := ChatHistoryEntry{
+		Username: username,
+		Msg:      msg,
+		Datetime: time.Now(),
+	}
+
+	roomHistoryMutex.Lock()
+	defer roomHistoryMutex.Unlock()
+
+	history := append(roomHistory[room], entry)
+	roomHistory[room] = pruneRoomHistory(history)
+}
+
+// pruneRoomHistory drops anything older than chatHistoryMaxAge and then caps the remainder at
+// chatHistoryMaxMessages, whichever constraint removes more.
+func pruneRoomHistory(history []ChatHistoryEntry) []ChatHistoryEntry {
+	cutoff := time.Now().Add(-chatHistoryMaxAge)
+
+	start := 0
+	for start < len(history) && history[start].Datetime.Before(cutoff) {
+		start++
+	}
+	history = history[start:]
+
+	if len(history) > chatHistoryMaxMessages {
+		history = history[len(history)-chatHistoryMaxMessages:]
+	}
+
+	return history
+}
+
+// replayRoomHistory returns up to n of the most recent buffered messages for a room, oldest
+// first. A non-positive n returns everything currently buffered.
+func replayRoomHistory(room string, n int) []ChatHistoryEntry {
+	roomHistoryMutex.Lock()
+	history := pruneRoomHistory(roomHistory[room])
+	roomHistory[room] = history
+	roomHistoryMutex.Unlock()
+
+	if n <= 0 || n >= len(history) {
+		return history
+	}
+
+	return history[len(history)-n:]
+}
+
+// forgetRoomHistory discards a room's buffered history entirely. It should be called whenever a
+// table is destroyed, so that its room name can be safely reused without leaking old messages.
+func forgetRoomHistory(room string) {
+	roomHistoryMutex.Lock()
+	delete(roomHistory, room)
+	roomHistoryMutex.Unlock()
+}
+
+// ChatHistoryMessage is what gets emitted to a client for each buffered message being replayed.
+// The "ServerTime" field (in RFC3339) lets the client render a "you missed..." gap indicator
+// instead of presenting replayed messages as if they just happened.
+type ChatHistoryMessage struct {
+	Username   string `json:"username"`
+	Msg        string `json:"msg"`
+	Room       string `json:"room"`
+	ServerTime string `json:"serverTime"`
+}
+
+// SendRoomHistory replays a room's buffered history to a single session. It is meant to be called
+// whenever a session (re)joins a room: on initial lobby connect and resume in "httpWS", and on
+// "commandTableJoin"/"commandTableSpectate" for a table's room.
+func SendRoomHistory(s *Session, room string) {
+	for _, entry := range replayRoomHistory(room, chatHistoryMaxMessages) {
+		s.Emit("chatHistory", &ChatHistoryMessage{
+			Username:   entry.Username,
+			Msg:        entry.Msg,
+			Room:       room,
+			ServerTime: entry.Datetime.Format(time.RFC3339),
+		})
+	}
+}
+
+// /history [N]
+// Mirrors the ergonomics of "/tags": dumps up to N recent messages in the current room directly
+// into the chat.
+func chatHistory(ctx context.Context, s *Session, d *CommandData, t *Table) {
+	room := d.Room
+	if room == "" {
+		room = "lobby"
+	}
+
+	n := 10
+	if len(d.Args) == 1 {
+		if v, err := strconv.Atoi(d.Args[0]); err != nil {
+			chatServerSend(ctx, "The format of the /history command is: /history [N]", room)
+			return
+		} else {
+			n = v
+		}
+	} else if len(d.Args) > 1 {
+		chatServerSend(ctx, "The format of the /history command is: /history [N]", room)
+		return
+	}
+
+	entries := replayRoomHistory(room, n)
+	if len(entries) == 0 {
+		chatServerSend(ctx, "There is no recent chat history for this room.", room)
+		return
+	}
+
+	chatServerSend(ctx, "The last "+strconv.Itoa(len(entries))+" messages in this room were:", room)
+	for _, entry := range entries {
+		msg := "[" + entry.Datetime.Format(time.RFC3339) + "] "
+		if entry.Username != "" {
+			msg += entry.Username + ": "
+		}
+		msg += entry.Msg
+		chatServerSend(ctx, msg, room)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnectionLimitsConfig holds the tunables for per-IP handshake throttling and concurrent
+// session caps. It lives alongside the rest of the server's runtime tunables and can be swapped
+// out at any time via ReloadConnectionLimits (e.g. from a config file reload).
+type ConnectionLimitsConfig struct {
+	// HandshakesPerMinute and HandshakeBurst define a token bucket per IP for WebSocket upgrade
+	// attempts.
+	HandshakesPerMinute float64
+	HandshakeBurst      float64
+
+	// MaxSessionsPerIP caps how many live *Sessions a single IP may hold at once. 0 means
+	// unlimited.
+	MaxSessionsPerIP int
+
+	// TrustedProxies lists the hosts (matched against r.RemoteAddr, with the port stripped) that
+	// are allowed to set "X-Forwarded-For". A request arriving directly from anywhere else has its
+	// header ignored, since otherwise any client could forge it to evade the handshake throttle
+	// and per-IP session cap, or to frame another IP for a ban.
+	TrustedProxies []string
+}
+
+// DefaultConnectionLimits is used until ReloadConnectionLimits is called with something else.
+var DefaultConnectionLimits = ConnectionLimitsConfig{
+	HandshakesPerMinute: 10,
+	HandshakeBurst:      3,
+	MaxSessionsPerIP:    20,
+	// The bundled nginx reverse proxy that this repo assumes sits in front of the server runs on
+	// the same host, so the proxy's connection to us always arrives from loopback.
+	TrustedProxies: []string{"127.0.0.1", "::1"},
+}
+
+var (
+	connectionLimitsMutex sync.RWMutex
+	connectionLimits      = DefaultConnectionLimits
+)
+
+// ReloadConnectionLimits atomically swaps in a new configuration.
+func ReloadConnectionLimits(cfg ConnectionLimitsConfig) {
+	connectionLimitsMutex.Lock()
+	connectionLimits = cfg
+	connectionLimitsMutex.Unlock()
+}
+
+func currentConnectionLimits() ConnectionLimitsConfig {
+	connectionLimitsMutex.RLock()
+	defer connectionLimitsMutex.RUnlock()
+	return connectionLimits
+}
+
+// handshakeBucket is a simple token bucket used to throttle WebSocket upgrade attempts per IP.
+type handshakeBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+var (
+	handshakeBucketsMutex sync.Mutex
+	handshakeBuckets      = make(map[string]*handshakeBucket)
+)
+
+// allowHandshake reports whether a new handshake attempt from ip is allowed right now. If it is
+// not, the returned duration is how long the caller should wait before retrying (suitable for a
+// "Retry-After" header).
+func allowHandshake(ip string) (bool, time.Duration) {
+	cfg := currentConnectionLimits()
+	refillPerSecond := cfg.HandshakesPerMinute / 60
+
+	handshakeBucketsMutex.Lock()
+	defer handshakeBucketsMutex.Unlock()
+
+	b, ok := handshakeBuckets[ip]
+	if !ok {
+		b = &handshakeBucket{tokens: cfg.HandshakeBurst, lastRefill: time.Now()}
+		handshakeBuckets[ip] = b
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.lastRefill).Seconds() * refillPerSecond
+	if b.tokens > cfg.HandshakeBurst {
+		b.tokens = cfg.HandshakeBurst
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / refillPerSecond * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+var (
+	ipSessionsMutex sync.Mutex
+	// ipSessions tracks the live sessions per IP in connection order (oldest first), so that the
+	// per-IP cap can evict the longest-standing connection rather than an arbitrary one.
+	ipSessions = make(map[string][]*Session)
+)
+
+// registerIPSession records that ip now holds session s, evicting the oldest session(s) for that
+// IP if doing so exceeds MaxSessionsPerIP.
+func registerIPSession(ip string, s *Session) {
+	cfg := currentConnectionLimits()
+
+	ipSessionsMutex.Lock()
+	ipSessions[ip] = append(ipSessions[ip], s)
+	var evicted []*Session
+	for cfg.MaxSessionsPerIP > 0 && len(ipSessions[ip]) > cfg.MaxSessionsPerIP {
+		oldest := ipSessions[ip][0]
+		ipSessions[ip] = ipSessions[ip][1:]
+		evicted = append(evicted, oldest)
+	}
+	ipSessionsMutex.Unlock()
+
+	for _, old := range evicted {
+		old.Error("Too many connections from your IP address; this session has been disconnected.")
+		old.Close()
+	}
+}
+
+// unregisterIPSession removes s from ip's bookkeeping. It should be called once a session is
+// fully and finally torn down (i.e. it was not resumed within the grace window).
+func unregisterIPSession(ip string, s *Session) {
+	ipSessionsMutex.Lock()
+	defer ipSessionsMutex.Unlock()
+
+	sessionsForIP := ipSessions[ip]
+	for i, existing := range sessionsForIP {
+		if existing == s {
+			ipSessions[ip] = append(sessionsForIP[:i], sessionsForIP[i+1:]...)
+			break
+		}
+	}
+	if len(ipSessions[ip]) == 0 {
+		delete(ipSessions, ip)
+	}
+}
+
+// realClientIP returns the IP that should be used for banning/throttling/logging purposes. The
+// repo assumes it is deployed behind the bundled nginx reverse proxy, which sets
+// "X-Forwarded-For" to the true client IP; r.RemoteAddr in that case is just the proxy. That
+// header is only trusted when r.RemoteAddr itself is one of TrustedProxies -- otherwise a client
+// could set any X-Forwarded-For it likes, rotating it per request to dodge the handshake
+// throttle and per-IP session cap, or setting someone else's real IP to get them banned.
+func realClientIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" && isTrustedProxy(host) {
+		// The header can be a comma-separated chain of proxies; the original client is first.
+		if candidate := strings.TrimSpace(strings.Split(xff, ",")[0]); candidate != "" {
+			return candidate, nil
+		}
+	}
+
+	return host, nil
+}
+
+// isTrustedProxy reports whether host (with any port already stripped) is allowed to set
+// "X-Forwarded-For".
+func isTrustedProxy(host string) bool {
+	cfg := currentConnectionLimits()
+	for _, trusted := range cfg.TrustedProxies {
+		if host == trusted {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"encoding/json"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	gsessions "github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -33,9 +35,10 @@ func httpWS(c *gin.Context) {
 	r := c.Request
 	w := c.Writer
 
-	// Parse the IP address
+	// Parse the IP address, preferring the "X-Forwarded-For" header set by the nginx reverse
+	// proxy that this repo assumes sits in front of the server
 	var ip string
-	if v, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
+	if v, err := realClientIP(r); err != nil {
 		msg := "Failed to parse the IP address:"
 		httpWSInternalError(c, msg, err)
 		return
@@ -45,6 +48,20 @@ func httpWS(c *gin.Context) {
 
 	logger.Debug("Entered the \"httpWS()\" function for IP: " + ip)
 
+	// Derive a fingerprint for this connection, independent of its IP, so that a "/ban
+	// fingerprint ..." has something real to check below and to store on the session.
+	fingerprint := computeSessionFingerprint(r)
+
+	// Throttle handshake attempts per IP before doing any other work
+	if allowed, retryAfter := allowHandshake(ip); !allowed {
+		msg := "IP \"" + ip + "\" exceeded the WebSocket handshake rate limit."
+		logger.Info(msg)
+		retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
 	// Check to see if their IP is banned
 	if banned, err := models.BannedIPs.Check(ip); err != nil {
 		msg := "Failed to check to see if the IP \"" + ip + "\" is banned:"
@@ -57,6 +74,16 @@ func httpWS(c *gin.Context) {
 		return
 	}
 
+	// Also check the new structured ban subsystem, which is what moderator "/ban" commands write
+	// to; unlike "models.BannedIPs", entries here carry an expiration.
+	if banned, remaining := CheckBan(BanTypeIP, ip); banned {
+		msg := "IP \"" + ip + "\" tried to establish a WebSocket connection, but they are banned."
+		reason := "Your IP address has been banned for " + remaining.Round(time.Second).String() +
+			". Please contact an administrator if you think this is a mistake."
+		httpWSDeny(c, msg, reason)
+		return
+	}
+
 	// Check to see if their IP is muted
 	var muted bool
 	if v, err := models.MutedIPs.Check(ip); err != nil {
@@ -79,6 +106,16 @@ func httpWS(c *gin.Context) {
 		userID = v.(int)
 	}
 
+	// Check to see if this userID is banned (e.g. a moderator ran "/ban userid <id> 24h")
+	if banned, remaining := CheckBan(BanTypeUserID, strconv.Itoa(userID)); banned {
+		msg := "User ID " + strconv.Itoa(userID) + " tried to establish a WebSocket connection, " +
+			"but they are banned."
+		reason := "You have been banned for " + remaining.Round(time.Second).String() +
+			". Please contact an administrator if you think this is a mistake."
+		httpWSDeny(c, msg, reason)
+		return
+	}
+
 	// Get the username for this user
 	var username string
 	if v, err := models.Users.GetUsername(userID); err == pgx.ErrNoRows {
@@ -99,6 +136,26 @@ func httpWS(c *gin.Context) {
 		username = v
 	}
 
+	// Check to see if this username is banned (e.g. a moderator ran "/ban username <name> 24h")
+	if banned, remaining := CheckBan(BanTypeUsername, username); banned {
+		msg := "User \"" + username + "\" tried to establish a WebSocket connection, but they are banned."
+		reason := "You have been banned for " + remaining.Round(time.Second).String() +
+			". Please contact an administrator if you think this is a mistake."
+		httpWSDeny(c, msg, reason)
+		return
+	}
+
+	// Check to see if this connection's fingerprint is banned (e.g. a moderator ran
+	// "/ban fingerprint <fingerprint> 24h" to follow someone across an IP/VPN rotation)
+	if banned, remaining := CheckBan(BanTypeSessionFingerprint, fingerprint); banned {
+		msg := "A connection from \"" + ip + "\" with a banned fingerprint tried to establish a " +
+			"WebSocket connection."
+		reason := "You have been banned for " + remaining.Round(time.Second).String() +
+			". Please contact an administrator if you think this is a mistake."
+		httpWSDeny(c, msg, reason)
+		return
+	}
+
 	// Get their friends and reverse friends
 	var friendsMap map[int]struct{}
 	if v, err := models.UserFriends.GetMap(userID); err != nil {
@@ -145,24 +202,133 @@ func httpWS(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	// Initialize the object that represents their WebSocket session
-	s := NewSession()
-	s.Conn = conn
-	s.UserID = userID
-	s.Username = username
-	s.Muted = muted
-	s.Friends = friendsMap
-	s.ReverseFriends = reverseFriendsMap
-	s.Hyphenated = hyphenated
+	// Attempt to resume a still-live session rather than allocating a fresh one, if the client
+	// supplied a resume token from a previous connection
+	resumeToken := r.URL.Query().Get("resumeToken")
+	s, resumed := resumeSession(resumeToken, userID, ip)
+
+	if resumed {
+		logger.Info("User \"" + username + "\" resumed an existing WebSocket session.")
+		s.Mutex.Lock()
+		s.Username = username
+		s.Muted = muted
+		s.Friends = friendsMap
+		s.ReverseFriends = reverseFriendsMap
+		s.Hyphenated = hyphenated
+		s.DatetimeLastSeen = time.Now()
+		s.Fingerprint = fingerprint
+		s.Mutex.Unlock()
+		s.startWriter(conn)
+		s.flushPendingEmits()
+	} else {
+		s = NewSession()
+		s.UserID = userID
+		s.Username = username
+		s.Muted = muted
+		s.Friends = friendsMap
+		s.ReverseFriends = reverseFriendsMap
+		s.Hyphenated = hyphenated
+		s.RemoteIP = ip
+		s.Fingerprint = fingerprint
+		s.startWriter(conn)
+		registerIPSession(ip, s)
+	}
+
+	if err := s.IssueResumeToken(); err != nil {
+		logger.Error("Failed to issue a resume token for user \""+username+"\":", err)
+	}
+
+	sessionConnectMutex.Lock()
+	sessionsMutex.Lock()
+	// A user is only ever allowed one live session; if they are already connected elsewhere (and
+	// this is not that same session resuming), boot the old one
+	previous, hadPrevious := sessions[userID]
+	sessions[userID] = s
+	sessionsMutex.Unlock()
+	sessionConnectMutex.Unlock()
+
+	if hadPrevious && previous != s {
+		previous.Error("You have logged in from elsewhere; this session has been disconnected.")
+		previous.Close()
+	}
+
+	// Replay anything they missed in the lobby, whether this is a fresh connection or a resume
+	SendRoomHistory(s, "lobby")
 
 	for {
 		// Read
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			logger.Error(err)
+			break
+		}
+
+		command, payload := parseIncomingMessage(msg)
+		if command == "chat" {
+			var d incomingChatData
+			if err := json.Unmarshal(payload, &d); err != nil {
+				logger.Info("Failed to unmarshal an incoming \"chat\" message from user \"" +
+					username + "\".")
+				continue
+			}
+
+			room := d.Room
+			if room == "" {
+				room = "lobby"
+			}
+			handleIncomingChat(r.Context(), s, room, d.Msg)
 		}
-		fmt.Printf("%s\n", msg)
 	}
+
+	websocketDisconnect(s)
+}
+
+// incomingChatData is the payload of an incoming "chat" WebSocket message.
+type incomingChatData struct {
+	Msg  string `json:"msg"`
+	Room string `json:"room"`
+}
+
+// parseIncomingMessage splits a raw incoming WebSocket frame into its command name and JSON
+// payload, mirroring the "command name" + json that Session.Emit writes on the way out.
+func parseIncomingMessage(msg []byte) (string, []byte) {
+	i := strings.IndexByte(string(msg), ' ')
+	if i == -1 {
+		return string(msg), nil
+	}
+	return string(msg[:i]), msg[i+1:]
+}
+
+// resumeSession looks for an existing, currently-disconnected Session for the given user that
+// was issued the supplied resume token, and reattaches it if found. The cookie's userID and the
+// connecting IP must both match what the session was established with, so that a stolen or
+// replayed token cannot be used to hijack a different user's seat.
+func resumeSession(resumeToken string, userID int, ip string) (*Session, bool) {
+	if resumeToken == "" {
+		return nil, false
+	}
+
+	sessionsMutex.RLock()
+	existing, ok := sessions[userID]
+	sessionsMutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	existing.Mutex.RLock()
+	sameUser := existing.UserID == userID
+	sameIP := existing.RemoteIP == ip
+	stillOffline := existing.Conn == nil
+	existing.Mutex.RUnlock()
+
+	if !sameUser || !sameIP || !stillOffline {
+		return nil, false
+	}
+
+	if !existing.ConsumeResumeToken(resumeToken) {
+		return nil, false
+	}
+
+	return existing, true
 }
 
 func httpWSInternalError(c *gin.Context, msg string, err error) {
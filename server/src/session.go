@@ -3,6 +3,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"sync"
 	"sync/atomic"
@@ -11,6 +13,33 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// resumeTokenTTL is how long a freshly minted resume token remains valid for reconnecting.
+	resumeTokenTTL = 5 * time.Minute
+
+	// resumeGraceWindow is how long a disconnected session is kept alive (and its seat held)
+	// so that a reconnecting client can resume it instead of being treated as a fresh departure.
+	resumeGraceWindow = 60 * time.Second
+
+	// pendingEmitsMax bounds how many messages we will buffer for a disconnected session before
+	// dropping the oldest ones.
+	pendingEmitsMax = 256
+
+	// outputBufferSize is the size of the per-connection outbox. A client that cannot keep up
+	// with this many queued frames is considered a slow consumer and is disconnected.
+	outputBufferSize = 64
+
+	// pingInterval is how often the writer goroutine pings the client to detect dead peers.
+	pingInterval = 30 * time.Second
+
+	// pongWait is how long we will wait for a pong before considering the connection dead; only
+	// a pong extends the read deadline.
+	pongWait = 60 * time.Second
+
+	// writeWait is the deadline given to a single WriteMessage call.
+	writeWait = 10 * time.Second
+)
+
 type Session struct {
 	Conn   *websocket.Conn
 	Mutex  *sync.RWMutex
@@ -30,6 +59,42 @@ type Session struct {
 	RateLimitAllowance float64
 	RateLimitLastCheck time.Time
 	Banned             bool
+
+	// RemoteIP is the IP address that was used to establish (or most recently resume) this
+	// session, so that a resume attempt from a materially different IP can be rejected.
+	RemoteIP string
+
+	// Fingerprint identifies the connecting client independently of its IP (see
+	// computeSessionFingerprint), so a "/ban fingerprint ..." can follow a VPN/IP rotation.
+	Fingerprint string
+
+	// ResumeToken and ResumeTokenExpiry support session resume: a dropped connection can reattach
+	// to this same Session by presenting this (single-use) token before it expires.
+	ResumeToken       string
+	ResumeTokenExpiry time.Time
+
+	// DatetimeLastSeen is updated whenever the underlying Conn goes away, and is used to enforce
+	// the resume grace window.
+	DatetimeLastSeen time.Time
+
+	// pendingEmits buffers frames that were generated while Conn was nil (i.e. the client is
+	// disconnected but still within the resume grace window) so that they can be replayed in
+	// order once the client resumes.
+	pendingEmits [][]byte
+
+	// output is the per-connection outbox that Emit pushes serialized frames onto. It is only
+	// non-nil while a writer goroutine owns the connection; it is recreated on every call to
+	// startWriter (i.e. on every fresh connection or resume).
+	output chan []byte
+
+	// done is closed exactly once per connection generation to signal the writer goroutine (and
+	// anything else watching) that the session is being torn down.
+	done chan struct{}
+
+	// closeOnce guards done/output/Conn teardown so that concurrent callers of Close cannot
+	// double-close a channel. It is reset (under Mutex) every time startWriter runs, since a
+	// resumed Session gets a brand new connection generation.
+	closeOnce *sync.Once
 }
 
 var (
@@ -42,12 +107,134 @@ func NewSession() *Session {
 	// Specify the default values used for both real sessions and fake sessions
 	return &Session{
 		SessionID:          atomic.AddUint64(&sessionIDCounter, 1),
+		Mutex:              &sync.RWMutex{},
 		UserID:             -1,
 		Status:             StatusLobby, // By default, new users are in the lobby
 		Friends:            make(map[int]struct{}),
 		ReverseFriends:     make(map[int]struct{}),
 		RateLimitAllowance: RateLimitRate,
 		RateLimitLastCheck: time.Now(),
+		DatetimeLastSeen:   time.Now(),
+	}
+}
+
+// generateResumeToken returns a cryptographically random, hex-encoded token suitable for
+// identifying a Session across a WebSocket reconnection.
+func generateResumeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IssueResumeToken mints a new resume token for this session and overwrites any previous one,
+// so that a previously issued token can no longer be used to resume (tokens are single-use).
+func (s *Session) IssueResumeToken() error {
+	token, err := generateResumeToken()
+	if err != nil {
+		return err
+	}
+
+	s.Mutex.Lock()
+	s.ResumeToken = token
+	s.ResumeTokenExpiry = time.Now().Add(resumeTokenTTL)
+	s.Mutex.Unlock()
+
+	return nil
+}
+
+// ConsumeResumeToken checks the supplied token against this session and, if it is valid and
+// unexpired, invalidates it (since resume tokens are single-use) and returns true.
+func (s *Session) ConsumeResumeToken(token string) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if token == "" || s.ResumeToken == "" || s.ResumeToken != token {
+		return false
+	}
+	if time.Now().After(s.ResumeTokenExpiry) {
+		return false
+	}
+
+	s.ResumeToken = ""
+	return true
+}
+
+// flushPendingEmits replays any frames buffered while the session was offline, in order. Must be
+// called after startWriter(conn); frames are pushed onto s.output rather than written to conn
+// directly, since writeLoop is the sole writer.
+func (s *Session) flushPendingEmits() {
+	s.Mutex.Lock()
+	pending := s.pendingEmits
+	s.pendingEmits = nil
+	output := s.output
+	s.Mutex.Unlock()
+
+	for _, bytes := range pending {
+		if output == nil {
+			return
+		}
+		select {
+		case output <- bytes:
+		default:
+			logger.Info("The output buffer for user \"" + s.Username + "\" is full while " +
+				"replaying buffered messages; disconnecting them as a slow consumer.")
+			s.Close()
+			return
+		}
+	}
+}
+
+// startWriter attaches conn to the session and spins up the writer goroutine that owns it. Call
+// once per connection (fresh connect or resume); this sets up a fresh output/done pair for the
+// new connection generation.
+func (s *Session) startWriter(conn *websocket.Conn) {
+	s.Mutex.Lock()
+	s.Conn = conn
+	s.Closed = false
+	output := make(chan []byte, outputBufferSize)
+	done := make(chan struct{})
+	s.output = output
+	s.done = done
+	s.closeOnce = &sync.Once{}
+	s.Mutex.Unlock()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait)) // nolint: errcheck
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go s.writeLoop(conn, output, done)
+}
+
+// writeLoop is the sole goroutine allowed to write to conn. It serializes Emit'd frames with
+// periodic pings so that dead peers are eventually detected and closed out.
+func (s *Session) writeLoop(conn *websocket.Conn, output chan []byte, done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-output:
+			conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint: errcheck
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				logger.Error("Failed to write to the session of user \""+s.Username+"\":", err)
+				s.Close()
+				return
+			}
+
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait)) // nolint: errcheck
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				logger.Error("Failed to ping the session of user \""+s.Username+"\":", err)
+				s.Close()
+				return
+			}
+
+		case <-done:
+			return
+		}
 	}
 }
 
@@ -62,8 +249,11 @@ func NewFakeSession(id int, name string) *Session {
 }
 
 // Emit sends a message to a client using the Golem-style protocol described above
+// If the session is currently disconnected, the message is buffered instead and replayed if/when
+// the client resumes. Otherwise the frame is handed to the writer goroutine via a non-blocking
+// send; a client whose outbox is full is considered a slow consumer and disconnected.
 func (s *Session) Emit(command string, d interface{}) {
-	if s == nil || s.Conn == nil {
+	if s == nil {
 		return
 	}
 
@@ -79,25 +269,63 @@ func (s *Session) Emit(command string, d interface{}) {
 	// Send the message as bytes
 	msg := command + " " + ds
 	bytes := []byte(msg)
-	if err := s.Conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
-		// Can this can routinely fail if the session is closed?
-		logger.Error("Failed to write to the session of user \""+s.Username+"\":", err)
+
+	// Hold the lock across the closed-check and the send so this can't race a concurrent Close().
+	s.Mutex.Lock()
+	if s.Closed || s.output == nil {
+		s.pendingEmits = append(s.pendingEmits, bytes)
+		if len(s.pendingEmits) > pendingEmitsMax {
+			s.pendingEmits = s.pendingEmits[len(s.pendingEmits)-pendingEmitsMax:]
+		}
+		s.Mutex.Unlock()
 		return
 	}
+
+	sent := false
+	select {
+	case s.output <- bytes:
+		sent = true
+	default:
+	}
+	s.Mutex.Unlock()
+
+	if !sent {
+		logger.Info("The output buffer for user \"" + s.Username + "\" is full; " +
+			"disconnecting them as a slow consumer.")
+		s.Close()
+	}
 }
 
+// Close tears down the session's current connection generation exactly once: it stops the writer
+// goroutine via done (s.output is deliberately never closed, to avoid racing a concurrent Emit's
+// send against it) and closes the underlying WebSocket connection. Safe to call concurrently and
+// more than once.
 func (s *Session) Close() {
-	if s.Closed {
+	s.Mutex.Lock()
+	once := s.closeOnce
+	s.Mutex.Unlock()
+
+	if once == nil {
 		return
 	}
 
-
+	once.Do(func() {
 		s.Mutex.Lock()
-		s.open = false
-		s.conn.Close()
-		close(s.output)
+		s.Closed = true
+		conn := s.Conn
+		done := s.done
+		s.Conn = nil
+		s.done = nil
+		s.output = nil
 		s.Mutex.Unlock()
-	}
+
+		if done != nil {
+			close(done)
+		}
+		if conn != nil {
+			conn.Close() // nolint: errcheck
+		}
+	})
 }
 
 func (s *Session) Warning(message string) {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestConsumeResumeTokenSingleUse exercises the single-use guarantee that resume relies on: of N
+// concurrent attempts to consume the same token, exactly one may succeed.
+func TestConsumeResumeTokenSingleUse(t *testing.T) {
+	s := NewSession()
+	if err := s.IssueResumeToken(); err != nil {
+		t.Fatalf("IssueResumeToken: %v", err)
+	}
+
+	s.Mutex.RLock()
+	token := s.ResumeToken
+	s.Mutex.RUnlock()
+
+	const attempts = 50
+	var successes int32
+	var wg sync.WaitGroup
+	wg.Add(attempts)
+	for i := 0; i < attempts; i++ {
+		go func() {
+			defer wg.Done()
+			if s.ConsumeResumeToken(token) {
+				atomic.AddInt32(&successes, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if successes != 1 {
+		t.Fatalf("got %d successful consumptions of the same token, want exactly 1", successes)
+	}
+}
+
+// TestSessionEmitCloseRace drives Emit and Close concurrently against a live writer goroutine, to
+// catch the "send on closed channel" panic that a regression here would reintroduce. Run with
+// "go test -race" to make the check meaningful.
+func TestSessionEmitCloseRace(t *testing.T) {
+	upgrader := websocket.Upgrader{} // nolint: exhaustivestruct
+	s := NewSession()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.startWriter(conn)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil) // nolint: bodyclose
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	// Drain whatever the writer goroutine sends so that Emit's non-blocking send path is
+	// exercised rather than immediately hitting the slow-consumer branch.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	// stop is closed rather than sent on, so that both goroutines below observe it.
+	stop := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(stop) })
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Emit("test", struct{}{})
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-stop
+		s.Close()
+	}()
+
+	wg.Wait()
+}
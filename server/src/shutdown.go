@@ -45,31 +45,12 @@ func shutdownXMinutesLeft(ctx context.Context, minutesLeft int) {
 
 	tableList := tables.GetList()
 
-	// Automatically end all unstarted tables,
-	// since they will almost certainly not have time to finish
+	// Automatically end all unstarted tables, since they will almost certainly not have time to
+	// finish. Each table's own actor goroutine decides whether it qualifies and locks/unlocks
+	// itself while doing so, so there is no need to scan-then-refetch-and-relock every table.
 	if minutesLeft == 5 {
-		unstartedTableIDs := make([]uint64, 0)
-
 		for _, t := range tableList {
-			t.Lock(ctx)
-			if !t.Running {
-				unstartedTableIDs = append(unstartedTableIDs, t.ID)
-			}
-			t.Unlock(ctx)
-		}
-
-		for _, unstartedTableID := range unstartedTableIDs {
-			t, exists := getTableAndLock(ctx, nil, unstartedTableID, true)
-			if !exists {
-				continue
-			}
-
-			s := t.GetOwnerSession()
-			commandTableLeave(ctx, s, &CommandData{ // nolint: exhaustivestruct
-				TableID: t.ID,
-				NoLock:  true,
-			})
-			t.Unlock(ctx)
+			sendTableAction(t, tableAction{actionType: tableActionCleanupUnstarted})
 		}
 	}
 
@@ -108,33 +89,14 @@ func shutdownWait(ctx context.Context) {
 			shutdownImmediate(ctx)
 			break
 		} else if numActiveTables > 0 && time.Since(datetimeShutdownInit) >= ShutdownTimeout {
-			// It has been a long time since the server shutdown/restart was initiated,
-			// so automatically terminate any remaining ongoing games
+			// It has been a long time since the server shutdown/restart was initiated, so
+			// automatically terminate any remaining ongoing games. Broadcasting a
+			// tableActionTerminate to every table lets each one decide for itself (while holding
+			// its own lock) whether it is actually running and not a replay, instead of us having
+			// to scan once to decide and then re-fetch-and-relock to act.
 			tableList := tables.GetList()
-			tableIDsToTerminate := make([]uint64, 0)
 			for _, t := range tableList {
-				t.Lock(ctx)
-				if t.Running && !t.Replay {
-					tableIDsToTerminate = append(tableIDsToTerminate, t.ID)
-				}
-				t.Unlock(ctx)
-			}
-
-			for _, tableIDToTerminate := range tableIDsToTerminate {
-				t, exists := getTableAndLock(ctx, nil, tableIDToTerminate, true)
-				if !exists {
-					continue
-				}
-
-				s := t.GetOwnerSession()
-				commandAction(ctx, s, &CommandData{ // nolint: exhaustivestruct
-					TableID: t.ID,
-					Type:    ActionTypeEndGame,
-					Target:  -1,
-					Value:   EndConditionTerminated,
-					NoLock:  true,
-				})
-				t.Unlock(ctx)
+				sendTableAction(t, tableAction{actionType: tableActionTerminate})
 			}
 		}
 
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// errTableExpired is the cause passed to context.WithTimeoutCause when a Table's context is
+// created, so that a table's own logs/sentry reports can tell "timed out because nobody ever
+// terminated it" apart from a caller-initiated cancellation.
+var errTableExpired = errors.New("table context exceeded its maximum lifetime")
+
+// tableActionType enumerates what a tableAction asks a table's actor goroutine to do.
+type tableActionType int
+
+const (
+	// tableActionCommand forwards a single command (chat, commandAction, etc.) to commandAction.
+	tableActionCommand tableActionType = iota
+
+	// tableActionCleanupUnstarted ends the table via commandTableLeave if it never started,
+	// e.g. during the 5-minutes-left shutdown warning.
+	tableActionCleanupUnstarted
+
+	// tableActionTerminate force-ends a running, non-replay table and stops its actor goroutine.
+	tableActionTerminate
+
+	// tableActionLeave removes action.session from the table via commandTableLeave, e.g. once a
+	// disconnected session's resume grace window has elapsed without it reconnecting.
+	tableActionLeave
+)
+
+// tableAction is a single message sent to a Table's actor goroutine. Every mutation to a table --
+// chat, commandAction, shutdown termination, unstarted-table cleanup -- becomes one of these and
+// is handled serially by runTableActor, which is what lets us get rid of the
+// lock-scan-then-refetch-and-relock dance that shutdown.go used to do.
+//
+// This does not remove the "NoLock" parameter that commandTableLeave/commandAction take (that
+// would require changing those functions, which live outside this chunk); handleTableAction below
+// still passes NoLock: true into them. What changes is who is allowed to do that: previously any
+// caller that had already scanned-and-relocked a table could pass NoLock: true, with no way to
+// verify that it actually still held the lock by the time the call landed. Now the actor is the
+// only caller that ever does, and it only does so from inside handleTableAction, which holds t's
+// lock for the entire switch -- so NoLock: true is always true when it is passed, rather than a
+// racy assumption.
+type tableAction struct {
+	actionType tableActionType
+
+	// Populated for tableActionCommand.
+	session *Session
+	data    *CommandData
+
+	// done, if non-nil, is closed once the action has been fully processed, so that a caller like
+	// shutdown() can block until every table has actually finished terminating.
+	done chan struct{}
+}
+
+// NOTE: Table itself is not part of this chunk. For this to compile, Table needs three new fields
+// populated by whatever currently constructs a Table (NewTable() or similar):
+//
+//	actions   chan tableAction  // buffered, e.g. make(chan tableAction, 8)
+//	ctx       context.Context   // from context.WithTimeoutCause(parentCtx, 4*time.Hour, errTableExpired)
+//	actorDone chan struct{}     // unbuffered, closed by runTableActor when it returns
+//
+// and that constructor should start the actor with `go runTableActor(t)` once all three are set.
+// Lock/Unlock/GetOwnerSession stay as thin shims on Table during the migration.
+
+// runTableActor is the per-Table actor goroutine. It is the only goroutine that is ever allowed
+// to call t.Lock/t.Unlock for t's own mutations; every other caller communicates by sending a
+// tableAction on t.actions instead. The table is automatically terminated if its context expires
+// (see errTableExpired) even if nobody ever explicitly sends a tableActionTerminate.
+//
+// Closing t.actorDone on the way out is what lets sendTableAction notice that this table will
+// never drain t.actions again, instead of blocking forever trying to enqueue into (or wait on) a
+// channel nothing is reading anymore.
+func runTableActor(t *Table) {
+	defer close(t.actorDone)
+
+	for {
+		select {
+		case action := <-t.actions:
+			handleTableAction(t.ctx, t, action)
+			if action.done != nil {
+				close(action.done)
+			}
+			if action.actionType == tableActionTerminate {
+				return
+			}
+
+		case <-t.ctx.Done():
+			handleTableAction(t.ctx, t, tableAction{actionType: tableActionTerminate})
+			return
+		}
+	}
+}
+
+func handleTableAction(ctx context.Context, t *Table, action tableAction) {
+	t.Lock(ctx)
+	defer t.Unlock(ctx)
+
+	switch action.actionType {
+	case tableActionCommand:
+		action.data.NoLock = true
+		commandAction(ctx, action.session, action.data)
+
+	case tableActionCleanupUnstarted:
+		if !t.Running {
+			s := t.GetOwnerSession()
+			commandTableLeave(ctx, s, &CommandData{ // nolint: exhaustivestruct
+				TableID: t.ID,
+				NoLock:  true,
+			})
+		}
+
+	case tableActionTerminate:
+		if t.Running && !t.Replay {
+			s := t.GetOwnerSession()
+			commandAction(ctx, s, &CommandData{ // nolint: exhaustivestruct
+				TableID: t.ID,
+				Type:    ActionTypeEndGame,
+				Target:  -1,
+				Value:   EndConditionTerminated,
+				NoLock:  true,
+			})
+		}
+
+	case tableActionLeave:
+		commandTableLeave(ctx, action.session, &CommandData{ // nolint: exhaustivestruct
+			TableID: t.ID,
+			NoLock:  true,
+		})
+	}
+}
+
+// sendTableAction enqueues an action on t's actor and blocks until the actor has finished
+// processing it, which is what lets shutdown()-style callers treat "broadcast to every table"
+// and "wait for every table to be done" as two separate, simple steps.
+//
+// Both selects also watch t.actorDone, so a table whose actor has already returned (e.g. it was
+// already terminated by a previous broadcast, or its context expired) can never make this block
+// forever: without that, a send into a full t.actions would hang with nothing left to drain it,
+// and the same is true of waiting on action.done if the send happened to land just as the actor
+// was exiting.
+func sendTableAction(t *Table, action tableAction) {
+	action.done = make(chan struct{})
+
+	select {
+	case t.actions <- action:
+	case <-t.actorDone:
+		return
+	}
+
+	select {
+	case <-action.done:
+	case <-t.actorDone:
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+)
+
+// websocketDisconnect is called once a Session's WebSocket read loop exits (the underlying Conn
+// is already gone or about to be). Rather than immediately tearing the user out of their table
+// and out of the sessions map, we mark the session as offline and give it resumeGraceWindow to be
+// reclaimed via resumeSession() before we fully remove it. This keeps a brief network blip from
+// affecting the rest of the table.
+func websocketDisconnect(s *Session) {
+	if s == nil {
+		return
+	}
+
+	s.Close()
+
+	s.Mutex.Lock()
+	s.DatetimeLastSeen = time.Now()
+	s.Mutex.Unlock()
+
+	time.AfterFunc(resumeGraceWindow, func() {
+		finalizeDisconnect(s)
+	})
+}
+
+// finalizeDisconnect removes a session that was not resumed within the grace window from the
+// sessions map and from its table. If the session was resumed in the meantime (s.Conn is set
+// again), this is a no-op. If a newer Session has since taken over this user's slot, only this
+// session's per-IP bookkeeping is dropped; the user keeps their seat.
+func finalizeDisconnect(s *Session) {
+	s.Mutex.RLock()
+	stillOffline := s.Conn == nil && time.Since(s.DatetimeLastSeen) >= resumeGraceWindow
+	s.Mutex.RUnlock()
+	if !stillOffline {
+		return
+	}
+
+	sessionsMutex.Lock()
+	existing, ok := sessions[s.UserID]
+	ownsSlot := ok && existing == s
+	if ownsSlot {
+		delete(sessions, s.UserID)
+	}
+	sessionsMutex.Unlock()
+
+	unregisterIPSession(s.RemoteIP, s)
+
+	if !ownsSlot {
+		return
+	}
+
+	logger.Info("User \"" + s.Username + "\" did not resume within the grace window; " +
+		"removing their session.")
+
+	if t := s.GetJoinedTable(); t != nil {
+		sendTableAction(t, tableAction{actionType: tableActionLeave, session: s})
+	}
+}